@@ -2,12 +2,73 @@ package v1alpha1
 
 import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-type DeviceSpec struct{}
+type DeviceSpec struct {
+	// Owner is the person or team responsible for this device.
+	Owner string `json:"owner,omitempty"`
+
+	// Contact is how to reach the owner of this device, e.g. an email.
+	Contact string `json:"contact,omitempty"`
+}
 
 type DeviceStatus struct {
 	// Registered denotes wether or not this device is considered as
 	// being registered or not.
 	Registered bool `json:"registered"`
+
+	// LastSeen is the last time this device registered with registrard.
+	LastSeen *metav1.Time `json:"lastSeen,omitempty"`
+
+	// AgentVersion is the version of the registrar agent this device last
+	// registered with.
+	AgentVersion string `json:"agentVersion,omitempty"`
+
+	// Outdated is set when this device's agent was refused for being older
+	// than the minimum agent version, until it registers with a newer one.
+	Outdated bool `json:"outdated,omitempty"`
+
+	// RemoteAddr is the address this device last registered from.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	// DampedUntil is set when this device registered too often and
+	// registrations from it are being refused until this time.
+	DampedUntil *metav1.Time `json:"dampedUntil,omitempty"`
+
+	// History is a bounded list of the most recent events that happened to
+	// this device, oldest first.
+	History []DeviceEvent `json:"history,omitempty"`
+}
+
+const (
+	// DeviceEventRegistered is recorded when a device first registers
+	DeviceEventRegistered = "Registered"
+
+	// DeviceEventReregistered is recorded when an existing device registers again
+	DeviceEventReregistered = "Reregistered"
+
+	// DeviceEventRemoteAddrChanged is recorded when a device registers from a
+	// different address than last time
+	DeviceEventRemoteAddrChanged = "RemoteAddrChanged"
+
+	// DeviceEventDamped is recorded when a device is held down for
+	// registering too often
+	DeviceEventDamped = "Damped"
+
+	// DeviceEventOutdated is recorded when a device is refused for running
+	// an agent older than the minimum agent version
+	DeviceEventOutdated = "Outdated"
+)
+
+// DeviceEvent is something that happened to a device.
+type DeviceEvent struct {
+	// Time is when the event happened.
+	Time metav1.Time `json:"time"`
+
+	// Reason is a short, machine readable reason for the event, e.g.
+	// Registered.
+	Reason string `json:"reason"`
+
+	// Message is a human readable description of the event.
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/internal/storage"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// storageFlags are the flags used by newDeviceStore
+func storageFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "storage",
+			Usage:   "Storage backend devices are stored in (kube, file)",
+			EnvVars: []string{"REGISTRARD_STORAGE"},
+			Value:   "kube",
+		},
+		&cli.StringFlag{
+			Name:    "storage-path",
+			Usage:   "Directory devices are stored in when using file storage",
+			EnvVars: []string{"REGISTRARD_STORAGE_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "namespace",
+			Usage:   "Namespace devices are stored in when using kube storage",
+			EnvVars: []string{"REGISTRARD_NAMESPACE"},
+			Value:   "registrar",
+		},
+	}
+}
+
+// newDeviceStore returns the device store configured by storageFlags
+func newDeviceStore(c *cli.Context) (storage.Store, error) {
+	return storage.New(storage.Options{
+		Backend:   c.String("storage"),
+		Namespace: c.String("namespace"),
+		Path:      c.String("storage-path"),
+	})
+}
+
+// newDevicesCommand returns a command for inspecting registered devices
+func newDevicesCommand(ctx context.Context) *cli.Command {
+	return &cli.Command{
+		Name:  "devices",
+		Usage: "Inspect registered devices",
+		Flags: storageFlags(),
+		Subcommands: []*cli.Command{
+			{
+				Name:      "history",
+				Usage:     "Show the recent history of a device",
+				ArgsUsage: "<name>",
+				Action: func(c *cli.Context) error {
+					return deviceHistory(ctx, c)
+				},
+			},
+		},
+	}
+}
+
+func deviceHistory(ctx context.Context, c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one device name")
+	}
+
+	devices, err := newDeviceStore(c)
+	if err != nil {
+		return err
+	}
+
+	d, err := devices.Get(ctx, c.Args().First())
+	if err != nil {
+		return errors.Wrap(err, "failed to get device")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tREASON\tMESSAGE")
+	for _, e := range d.Status.History {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Time.UTC().Format(time.RFC3339), e.Reason, e.Message)
+	}
+	return errors.Wrap(w.Flush(), "failed to write history")
+}
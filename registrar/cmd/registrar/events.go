@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// newEventsCommand returns a command that streams device lifecycle events
+// from registrard
+func newEventsCommand(ctx context.Context) *cli.Command {
+	return &cli.Command{
+		Name:  "events",
+		Usage: "Stream device lifecycle events from registrard as JSON lines",
+		Flags: []cli.Flag{
+			&cli.Uint64Flag{
+				Name:  "after",
+				Usage: "Resume after the event with this sequence, 0 starts from the oldest retained event",
+			},
+			&cli.StringFlag{
+				Name:  "epoch",
+				Usage: "Epoch of the event being resumed from, fails if registrard's events are from another epoch",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return streamEvents(ctx, c)
+		},
+	}
+}
+
+func streamEvents(ctx context.Context, c *cli.Context) error {
+	r, err := newRegistrarClient(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	stream, err := r.Events(ctx, &api.EventsRequest{
+		AuthToken:     c.String("registrard-token"),
+		AfterSequence: c.Uint64("after"),
+		Epoch:         c.String("epoch"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to stream events")
+	}
+
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to receive event")
+		}
+
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode event")
+		}
+		fmt.Println(string(b))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/internal/storage"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// inventoryEntry is a single device in an inventory export
+type inventoryEntry struct {
+	Name         string            `json:"name"`
+	ID           string            `json:"id"`
+	Registered   bool              `json:"registered"`
+	AgentVersion string            `json:"agentVersion,omitempty"`
+	Outdated     bool              `json:"outdated,omitempty"`
+	RemoteAddr   string            `json:"remoteAddr,omitempty"`
+	DampedUntil  *time.Time        `json:"dampedUntil,omitempty"`
+	Owner        string            `json:"owner,omitempty"`
+	Contact      string            `json:"contact,omitempty"`
+	EnrolledAt   time.Time         `json:"enrolledAt"`
+	LastSeen     *time.Time        `json:"lastSeen,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// newExportCommand returns a command that exports data about registered devices
+func newExportCommand(ctx context.Context) *cli.Command {
+	return &cli.Command{
+		Name:  "export",
+		Usage: "Export data about registered devices",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "inventory",
+				Usage: "Export an inventory of all registered devices",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format (csv, json)",
+						Value:   "csv",
+					},
+					&cli.StringFlag{
+						Name:  "owner",
+						Usage: "Only export devices owned by this owner",
+					},
+				}, storageFlags()...),
+				Action: func(c *cli.Context) error {
+					return exportInventory(ctx, c)
+				},
+			},
+		},
+	}
+}
+
+// getInventory returns all devices, sorted by name. If owner is set, only
+// devices with that owner are returned.
+func getInventory(ctx context.Context, devices storage.Store, owner string) ([]inventoryEntry, error) {
+	l, err := devices.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+
+	entries := make([]inventoryEntry, 0, len(l))
+	for i := range l {
+		d := &l[i]
+		if owner != "" && d.Spec.Owner != owner {
+			continue
+		}
+
+		e := inventoryEntry{
+			Name:         d.Name,
+			ID:           string(d.UID),
+			Registered:   d.Status.Registered,
+			AgentVersion: d.Status.AgentVersion,
+			Outdated:     d.Status.Outdated,
+			RemoteAddr:   d.Status.RemoteAddr,
+			Owner:        d.Spec.Owner,
+			Contact:      d.Spec.Contact,
+			EnrolledAt:   d.CreationTimestamp.UTC(),
+			Tags:         d.Labels,
+			Annotations:  d.Annotations,
+		}
+		if d.Status.LastSeen != nil {
+			lastSeen := d.Status.LastSeen.UTC()
+			e.LastSeen = &lastSeen
+		}
+		if d.Status.DampedUntil != nil {
+			dampedUntil := d.Status.DampedUntil.UTC()
+			e.DampedUntil = &dampedUntil
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// formatMap formats a map as a stable, semi-colon separated list of key=value
+func formatMap(m map[string]string) string {
+	l := make([]string, 0, len(m))
+	for k, v := range m {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ";")
+}
+
+func exportInventory(ctx context.Context, c *cli.Context) error {
+	devices, err := newDeviceStore(c)
+	if err != nil {
+		return err
+	}
+
+	entries, err := getInventory(ctx, devices, c.String("owner"))
+	if err != nil {
+		return err
+	}
+
+	switch c.String("output") {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(entries), "failed to encode inventory")
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		if err := w.Write([]string{"name", "id", "registered", "agent_version", "outdated", "remote_addr", "owner", "contact", "enrolled_at", "last_seen", "damped_until", "tags", "annotations"}); err != nil {
+			return errors.Wrap(err, "failed to write inventory")
+		}
+
+		for _, e := range entries {
+			lastSeen := ""
+			if e.LastSeen != nil {
+				lastSeen = e.LastSeen.Format(time.RFC3339)
+			}
+			dampedUntil := ""
+			if e.DampedUntil != nil {
+				dampedUntil = e.DampedUntil.Format(time.RFC3339)
+			}
+
+			if err := w.Write([]string{
+				e.Name, e.ID, strconv.FormatBool(e.Registered), e.AgentVersion, strconv.FormatBool(e.Outdated), e.RemoteAddr, e.Owner, e.Contact,
+				e.EnrolledAt.Format(time.RFC3339), lastSeen, dampedUntil, formatMap(e.Tags), formatMap(e.Annotations),
+			}); err != nil {
+				return errors.Wrap(err, "failed to write inventory")
+			}
+		}
+
+		w.Flush()
+		return errors.Wrap(w.Error(), "failed to write inventory")
+	}
+
+	return fmt.Errorf("unknown output format '%s'", c.String("output"))
+}
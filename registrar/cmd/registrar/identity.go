@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+)
+
+// metadataGet makes a request to a cloud metadata server and returns the body
+func metadataGet(ctx context.Context, method, u string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	h := &http.Client{Timeout: 10 * time.Second}
+	resp, err := h.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to execute request")
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read body")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got non 200 status code %d: %s", resp.StatusCode, string(b))
+	}
+
+	return string(b), nil
+}
+
+// getInstanceIdentity fetches a signed instance identity from the
+// metadata server of the given cloud provider
+func getInstanceIdentity(ctx context.Context, provider, audience string) (*api.InstanceIdentity, error) {
+	switch provider {
+	case "aws":
+		// IMDSv2 requires a session token
+		token, err := metadataGet(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token",
+			map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "300"})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get metadata token")
+		}
+		headers := map[string]string{"X-aws-ec2-metadata-token": token}
+
+		doc, err := metadataGet(ctx, http.MethodGet, "http://169.254.169.254/latest/dynamic/instance-identity/document", headers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get instance identity document")
+		}
+
+		sig, err := metadataGet(ctx, http.MethodGet, "http://169.254.169.254/latest/dynamic/instance-identity/signature", headers)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get instance identity signature")
+		}
+
+		return &api.InstanceIdentity{Provider: provider, Document: doc, Signature: sig}, nil
+	case "gcp":
+		if audience == "" {
+			return nil, fmt.Errorf("an audience is required for gcp instance identity")
+		}
+
+		q := url.Values{}
+		q.Set("audience", audience)
+		q.Set("format", "full")
+		token, err := metadataGet(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?"+q.Encode(),
+			map[string]string{"Metadata-Flavor": "Google"})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get instance identity token")
+		}
+
+		return &api.InstanceIdentity{Provider: provider, Document: token}, nil
+	}
+
+	return nil, fmt.Errorf("unknown cloud identity provider '%s'", provider)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// newLoadtestCommand returns a command that registers synthetic devices
+// against registrard and reports how long registration took
+func newLoadtestCommand(ctx context.Context) *cli.Command {
+	return &cli.Command{
+		Name:  "loadtest",
+		Usage: "Register synthetic devices with registrard and report latency",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "peers",
+				Usage: "Number of synthetic devices to register",
+				Value: 100,
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Number of registrations to run in parallel",
+				Value: 10,
+			},
+			&cli.StringFlag{
+				Name:  "id-prefix",
+				Usage: "Prefix for synthetic device IDs, makes them easy to clean up",
+				Value: "loadtest",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return loadtest(ctx, c)
+		},
+	}
+}
+
+func loadtest(ctx context.Context, c *cli.Context) error { //nolint:funlen
+	peers := c.Int("peers")
+	concurrency := c.Int("concurrency")
+	if peers <= 0 || concurrency <= 0 {
+		return fmt.Errorf("--peers and --concurrency must be greater than zero")
+	}
+
+	r, err := newRegistrarClient(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"peers": peers, "concurrency": concurrency}).
+		Info("starting registration load test")
+
+	ids := make(chan string)
+	go func() {
+		defer close(ids)
+		for i := 0; i < peers; i++ {
+			ids <- fmt.Sprintf("%s-%s", c.String("id-prefix"), uuid.New().String())
+		}
+	}()
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, peers)
+		failures  int
+		wg        sync.WaitGroup
+	)
+
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				reqStart := time.Now()
+				_, err := r.Register(ctx, &api.RegisterRequest{
+					Id:           id,
+					AuthToken:    c.String("registrard-token"),
+					AgentVersion: version,
+				})
+				took := time.Since(reqStart)
+
+				mu.Lock()
+				if err != nil {
+					failures++
+					log.WithError(err).WithField("id", id).Warn("failed to register synthetic device")
+				} else {
+					latencies = append(latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if len(latencies) == 0 {
+		return errors.Errorf("all %d registrations failed", failures)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	// every successful registration creates a Device, plus whatever the
+	// provisioning templates create, so the device write rate is a lower
+	// bound on writes to the API server
+	fmt.Printf("registrations: %d succeeded, %d failed in %s\n", len(latencies), failures, elapsed.Round(time.Millisecond))
+	fmt.Printf("write rate:    %.2f devices/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("latency:       p50=%s p90=%s p99=%s max=%s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+
+	return nil
+}
+
+// percentile returns the p-th percentile of an already sorted list of durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
@@ -15,12 +15,15 @@ import (
 	"github.com/jaredallard-home/worker-nodes/registrar/api"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/tritonmedia/pkg/app"
 	"github.com/urfave/cli/v2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
+// version is the version of registrar, set at build time with
+// -ldflags "-X main.version=..." and reported to registrard
+var version = "v0.0.0"
+
 // copyFile is a suitable file copier for small files
 func copyFile(src, dest string) error {
 	f, err := os.Stat(src)
@@ -105,13 +108,30 @@ func agentMode(ctx context.Context, resp *api.RegisterResponse) error {
 	)
 }
 
+// newRegistrarClient dials registrard using the global connection flags
+func newRegistrarClient(ctx context.Context, c *cli.Context) (api.RegistrarClient, error) {
+	grpcOption := make([]grpc.DialOption, 0)
+	if c.Bool("registrard-enable-tls") {
+		grpcOption = append(grpcOption, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	} else {
+		grpcOption = append(grpcOption, grpc.WithInsecure())
+	}
+
+	conn, err := grpc.DialContext(ctx, c.String("registrard-host"), grpcOption...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to registrard")
+	}
+
+	return api.NewRegistrarClient(conn), nil
+}
+
 func main() { //nolint:funlen,gocyclo
 	ctx := context.Background()
 
 	app := cli.App{
 		Name:    "registrar",
 		Usage:   "Configure a device using a remote registrar server",
-		Version: app.Version,
+		Version: version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "registrard-host",
@@ -134,6 +154,32 @@ func main() { //nolint:funlen,gocyclo
 				Usage:   "registrard auth token",
 				EnvVars: []string{"REGISTRARD_TOKEN"},
 			},
+			&cli.StringFlag{
+				Name:    "owner",
+				Usage:   "Person or team responsible for this device",
+				EnvVars: []string{"REGISTRAR_OWNER"},
+			},
+			&cli.StringFlag{
+				Name:    "contact",
+				Usage:   "How to reach the owner of this device, e.g. an email",
+				EnvVars: []string{"REGISTRAR_CONTACT"},
+			},
+			&cli.StringFlag{
+				Name:    "cloud-identity",
+				Usage:   "Register using this cloud provider's instance identity (aws, gcp) instead of a token",
+				EnvVars: []string{"REGISTRAR_CLOUD_IDENTITY"},
+			},
+			&cli.StringFlag{
+				Name:    "cloud-identity-audience",
+				Usage:   "Audience to request gcp identity tokens for, must match registrard",
+				EnvVars: []string{"REGISTRAR_CLOUD_IDENTITY_AUDIENCE"},
+			},
+		},
+		Commands: []*cli.Command{
+			newLoadtestCommand(ctx),
+			newExportCommand(ctx),
+			newDevicesCommand(ctx),
+			newEventsCommand(ctx),
 		},
 		Action: func(c *cli.Context) error {
 			if c.Bool("leader-mode") {
@@ -159,23 +205,27 @@ func main() { //nolint:funlen,gocyclo
 				id = string(b)
 			}
 
-			grpcOption := make([]grpc.DialOption, 0)
-			if c.Bool("registrard-enable-tls") {
-				grpcOption = append(grpcOption, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
-			} else {
-				grpcOption = append(grpcOption, grpc.WithInsecure())
+			r, err := newRegistrarClient(ctx, c)
+			if err != nil {
+				return err
 			}
 
-			conn, err := grpc.DialContext(ctx, host, grpcOption...)
-			if err != nil {
-				return errors.Wrap(err, "failed to connect to registrard")
+			req := &api.RegisterRequest{
+				Id:           id,
+				AuthToken:    c.String("registrard-token"),
+				AgentVersion: version,
+				Owner:        c.String("owner"),
+				Contact:      c.String("contact"),
+			}
+
+			if provider := c.String("cloud-identity"); provider != "" {
+				req.InstanceIdentity, err = getInstanceIdentity(ctx, provider, c.String("cloud-identity-audience"))
+				if err != nil {
+					return errors.Wrap(err, "failed to get cloud instance identity")
+				}
 			}
 
-			r := api.NewRegistrarClient(conn)
-			regResp, err := r.Register(ctx, &api.RegisterRequest{
-				Id:        id,
-				AuthToken: c.String("registrard-token"),
-			})
+			regResp, err := r.Register(ctx, req)
 			if err != nil {
 				return errors.Wrap(err, "failed to register devices")
 			}
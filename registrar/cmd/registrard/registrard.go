@@ -8,25 +8,39 @@ import (
 
 	"github.com/jaredallard-home/worker-nodes/registrar/internal/registrard"
 	"github.com/sirupsen/logrus"
-	"github.com/tritonmedia/pkg/app"
 	"github.com/tritonmedia/pkg/service"
 	"github.com/urfave/cli/v2"
 )
 
+// version is the version of registrard, set at build time with
+// -ldflags "-X main.version=..."
+var version = "v0.0.0"
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	log := logrus.New().WithContext(ctx)
 
 	app := cli.App{
 		Name:    "registrar",
-		Version: app.Version,
+		Version: version,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "read-only",
+				Usage:   "Serve registration information for existing devices, but refuse all changes",
+				EnvVars: []string{"REGISTRARD_READ_ONLY"},
+			},
+		},
 	}
 	app.Action = func(c *cli.Context) error {
 		r := service.NewServiceRunner(ctx, []service.Service{
 			&registrard.ShutdownService{},
-			&registrard.GRPCService{},
+			&registrard.GRPCService{
+				Options: registrard.ServerOptions{
+					ReadOnly: c.Bool("read-only"),
+				},
+			},
 		})
-		sigC := make(chan os.Signal)
+		sigC := make(chan os.Signal, 1)
 
 		// listen for signals that we want to cancel on, and cancel
 		// the context if one is passed
@@ -0,0 +1,114 @@
+package registrard
+
+import (
+	"sync"
+	"time"
+)
+
+// damper tracks how often devices register and holds down devices that
+// register too often, e.g. because they are boot looping. Every time a
+// device is held down again the hold down doubles, up to maxHoldDown.
+type damper struct {
+	mu  sync.Mutex
+	now func() time.Time
+
+	// threshold is the number of registrations allowed within window
+	threshold int
+	window    time.Duration
+
+	minHoldDown time.Duration
+	maxHoldDown time.Duration
+
+	devices   map[string]*damperState
+	lastPrune time.Time
+}
+
+type damperState struct {
+	attempts []time.Time
+	holdDown time.Duration
+	until    time.Time
+}
+
+func newDamper(threshold int, window time.Duration) *damper {
+	return &damper{
+		now:         time.Now,
+		threshold:   threshold,
+		window:      window,
+		minHoldDown: time.Minute,
+		maxHoldDown: time.Hour,
+		devices:     make(map[string]*damperState),
+	}
+}
+
+// Allow records a registration attempt for a device, or for an address
+// that devices without an ID register from. If the device is held down,
+// the time it is held down until is returned, and started is true if this
+// attempt is the one that caused the hold down.
+func (d *damper) Allow(id string) (heldUntil time.Time, started bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.prune(now)
+
+	st, ok := d.devices[id]
+	if !ok {
+		st = &damperState{}
+		d.devices[id] = st
+	}
+
+	if now.Before(st.until) {
+		return st.until, false
+	}
+
+	// forget attempts outside of the window
+	attempts := st.attempts[:0]
+	for _, t := range st.attempts {
+		if now.Sub(t) < d.window {
+			attempts = append(attempts, t)
+		}
+	}
+	st.attempts = append(attempts, now)
+
+	// a device that stayed quiet for a full window after its last hold
+	// down is forgiven
+	if st.holdDown != 0 && len(st.attempts) == 1 && now.Sub(st.until) >= d.window {
+		st.holdDown = 0
+	}
+
+	if len(st.attempts) <= d.threshold {
+		return time.Time{}, false
+	}
+
+	st.holdDown *= 2
+	if st.holdDown < d.minHoldDown {
+		st.holdDown = d.minHoldDown
+	}
+	if st.holdDown > d.maxHoldDown {
+		st.holdDown = d.maxHoldDown
+	}
+	st.until = now.Add(st.holdDown)
+	st.attempts = nil
+
+	return st.until, true
+}
+
+// prune forgets devices that haven't registered for a window and aren't
+// held down, at most once a window, as they'd be forgiven anyway. d.mu
+// must be held.
+func (d *damper) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < d.window {
+		return
+	}
+	d.lastPrune = now
+
+	for id, st := range d.devices {
+		if now.Sub(st.until) < d.window {
+			continue
+		}
+		if n := len(st.attempts); n != 0 && now.Sub(st.attempts[n-1]) < d.window {
+			continue
+		}
+		delete(d.devices, id)
+	}
+}
@@ -0,0 +1,75 @@
+package registrard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDamper(t *testing.T) {
+	now := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	d := newDamper(3, 5*time.Minute)
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if until, _ := d.Allow("device"); !until.IsZero() {
+			t.Fatalf("expected registration %d to be allowed", i+1)
+		}
+		now = now.Add(time.Second)
+	}
+
+	until, started := d.Allow("device")
+	if !started || !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected a 1m hold down to start, got until=%s started=%v", until, started)
+	}
+
+	if _, started := d.Allow("device"); started {
+		t.Error("expected attempts during a hold down to not start a new one")
+	}
+
+	if until, _ := d.Allow("other-device"); !until.IsZero() {
+		t.Error("expected other devices to not be held down")
+	}
+
+	// flapping again right after the hold down doubles it
+	now = until
+	for i := 0; i < 3; i++ {
+		d.Allow("device")
+	}
+	until, started = d.Allow("device")
+	if !started || !until.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("expected a 2m hold down to start, got until=%s started=%v", until, started)
+	}
+
+	// staying quiet for a window resets the hold down
+	now = until.Add(5 * time.Minute)
+	for i := 0; i < 3; i++ {
+		d.Allow("device")
+	}
+	until, _ = d.Allow("device")
+	if !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected hold down to reset to 1m, got until=%s", until)
+	}
+}
+
+func TestDamperPrune(t *testing.T) {
+	now := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	d := newDamper(1, 5*time.Minute)
+	d.now = func() time.Time { return now }
+
+	d.Allow("quiet")
+	d.Allow("held")
+	if until, _ := d.Allow("held"); until.IsZero() {
+		t.Fatal("expected device to be held down")
+	}
+
+	// one window later the quiet device is forgotten, but the held down
+	// device isn't as it has only just been released
+	now = now.Add(5 * time.Minute)
+	d.Allow("other")
+	if _, ok := d.devices["quiet"]; ok {
+		t.Error("expected quiet device to be pruned")
+	}
+	if _, ok := d.devices["held"]; !ok {
+		t.Error("expected recently held down device to not be pruned")
+	}
+}
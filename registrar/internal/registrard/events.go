@@ -0,0 +1,262 @@
+package registrard
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// errEventsUnavailable is returned when a consumer asks for events that
+// are no longer retained, or that are from another epoch
+var errEventsUnavailable = errors.New("requested events are not available")
+
+// eventLog is an ordered log of device lifecycle events that consumers
+// can stream from any retained sequence. If a path is configured the log
+// is persisted to it, one JSON encoded event per line, so sequences
+// survive restarts. Otherwise every process starts a new epoch, which
+// consumers resuming from an older one are told about.
+type eventLog struct {
+	mu        sync.Mutex
+	epoch     string
+	events    []*api.Event
+	sequence  uint64
+	retention int
+
+	// changed is closed, and replaced, whenever an event is published
+	changed chan struct{}
+
+	// done is closed when the log is closed
+	done chan struct{}
+
+	// path is the file the log is persisted to, and written is the number
+	// of events in it
+	path    string
+	f       *os.File
+	written int
+}
+
+// newEventLog creates an event log retaining the last retention events,
+// loading and persisting them to path if it's set
+func newEventLog(path string, retention int) (*eventLog, error) {
+	if retention <= 0 {
+		return nil, fmt.Errorf("events retention must be greater than zero")
+	}
+
+	l := &eventLog{
+		retention: retention,
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+		path:      path,
+	}
+
+	if path == "" {
+		l.epoch = uuid.New().String()
+		return l, nil
+	}
+
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+
+	// a persisted log keeps its epoch for as long as it has events
+	if l.epoch == "" {
+		l.epoch = uuid.New().String()
+		for _, e := range l.events {
+			e.Epoch = l.epoch
+		}
+	}
+
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// compact rewrites the log file with only the retained events so it
+// doesn't grow forever, l.mu must be held
+func (l *eventLog) compact() error {
+	tmp := l.path + ".tmp"
+	var buf []byte
+	for _, e := range l.events {
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode event")
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return errors.Wrap(err, "failed to compact event log")
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return errors.Wrap(err, "failed to compact event log")
+	}
+
+	if l.f != nil {
+		l.f.Close()
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		l.f = nil
+		return errors.Wrap(err, "failed to open event log")
+	}
+	l.f = f
+	l.written = len(l.events)
+
+	return nil
+}
+
+// load reads all events from path, if it exists
+func (l *eventLog) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to open event log")
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		e := &api.Event{}
+		if err := protojson.Unmarshal(s.Bytes(), e); err != nil {
+			return errors.Wrap(err, "failed to parse event log")
+		}
+		l.epoch = e.Epoch
+		l.append(e)
+	}
+
+	return errors.Wrap(s.Err(), "failed to read event log")
+}
+
+// append adds an event to the retained events, l.mu must be held
+func (l *eventLog) append(e *api.Event) {
+	l.sequence = e.Sequence
+	l.events = append(l.events, e)
+	if over := len(l.events) - l.retention; over > 0 {
+		l.events = l.events[over:]
+	}
+}
+
+// Publish adds device events to the log and wakes up all consumers
+func (l *eventLog) Publish(deviceID string, events ...registrar.DeviceEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return fmt.Errorf("event log is closed")
+	default:
+	}
+
+	for i := range events {
+		e := &api.Event{
+			Sequence: l.sequence + 1,
+			Time:     timestamppb.New(events[i].Time.Time),
+			DeviceId: deviceID,
+			Reason:   events[i].Reason,
+			Message:  events[i].Message,
+			Epoch:    l.epoch,
+		}
+
+		if l.f != nil {
+			b, err := protojson.Marshal(e)
+			if err != nil {
+				return errors.Wrap(err, "failed to encode event")
+			}
+			if _, err := l.f.Write(append(b, '\n')); err != nil {
+				return errors.Wrap(err, "failed to write event")
+			}
+			l.written++
+		}
+
+		l.append(e)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	if l.f != nil && l.written >= 2*l.retention {
+		return l.compact()
+	}
+
+	return nil
+}
+
+// Since returns all events after a sequence, and a channel that is closed
+// when new events are published after the returned ones. If epoch is set
+// it must be the epoch of the log.
+func (l *eventLog) Since(epoch string, after uint64) ([]*api.Event, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if epoch != "" && epoch != l.epoch {
+		return nil, nil, errors.Wrap(errEventsUnavailable,
+			fmt.Sprintf("events are from epoch %s, not %s", l.epoch, epoch))
+	}
+
+	// a sequence we haven't reached yet means the events it came from
+	// were lost
+	if after > l.sequence {
+		return nil, nil, errors.Wrap(errEventsUnavailable,
+			fmt.Sprintf("latest event is %d", l.sequence))
+	}
+
+	// 0 always starts from the oldest retained event
+	if after != 0 && len(l.events) != 0 && after+1 < l.events[0].Sequence {
+		return nil, nil, errors.Wrap(errEventsUnavailable,
+			fmt.Sprintf("oldest retained event is %d", l.events[0].Sequence))
+	}
+
+	events := make([]*api.Event, 0)
+	for _, e := range l.events {
+		if e.Sequence > after {
+			events = append(events, e)
+		}
+	}
+
+	return events, l.changed, nil
+}
+
+// Done returns a channel that is closed when the log is closed
+func (l *eventLog) Done() <-chan struct{} {
+	return l.done
+}
+
+// Close stops publishing events and closes the event log file, if there
+// is one
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+	close(l.done)
+
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
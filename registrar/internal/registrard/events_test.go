@@ -0,0 +1,147 @@
+package registrard
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrar-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events")
+
+	if _, err := newEventLog(path, 0); err == nil {
+		t.Error("expected a retention of 0 to be rejected")
+	}
+
+	l, err := newEventLog(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := l.epoch
+
+	_, changed, err := l.Since("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := registrar.DeviceEvent{Time: metav1.Now(), Reason: registrar.DeviceEventRegistered}
+	if err := l.Publish("device", e, e, e); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	default:
+		t.Error("expected publishing to wake up consumers")
+	}
+
+	events, _, err := l.Since("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Sequence != 2 {
+		t.Errorf("expected 0 to start from the oldest retained event 2, got %v", events)
+	}
+
+	if _, _, err := l.Since(epoch, 0); err != nil {
+		t.Errorf("expected 0 to never be a dropped sequence, got: %v", err)
+	}
+
+	if _, _, err := l.Since("", 4); !errors.Is(err, errEventsUnavailable) {
+		t.Errorf("expected errEventsUnavailable for a sequence after the latest event, got: %v", err)
+	}
+
+	if _, _, err := l.Since("other", 3); !errors.Is(err, errEventsUnavailable) {
+		t.Errorf("expected errEventsUnavailable for another epoch, got: %v", err)
+	}
+
+	events, _, err = l.Since(epoch, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Sequence != 2 || events[0].DeviceId != "device" || events[0].Epoch != epoch {
+		t.Errorf("expected events 2 and 3, got %v", events)
+	}
+	l.Close()
+
+	// sequences and the epoch continue from the persisted log
+	l, err = newEventLog(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Publish("device", e); err != nil {
+		t.Fatal(err)
+	}
+	events, _, err = l.Since(epoch, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Sequence != 4 {
+		t.Errorf("expected event 4 after reloading, got %v", events)
+	}
+
+	// the file is compacted while publishing, not only when it's loaded
+	if err := l.Publish("device", e, e, e); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(b, []byte("\n")); lines > 4 {
+		t.Errorf("expected the event log to be compacted, got %d events", lines)
+	}
+
+	_, changed, err = l.Since(epoch, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l.Done():
+	default:
+		t.Error("expected closing the log to stop consumers")
+	}
+	if err := l.Publish("device", e); err == nil {
+		t.Error("expected publishing to a closed log to fail")
+	}
+	select {
+	case <-changed:
+		t.Error("expected nothing to be published to a closed log")
+	default:
+	}
+}
+
+func TestEventLogWithoutPath(t *testing.T) {
+	l, err := newEventLog("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted registrard without a persisted log has lost all events,
+	// consumers resuming from before the restart must not skip any
+	if _, _, err := l.Since("", 5000); !errors.Is(err, errEventsUnavailable) {
+		t.Errorf("expected errEventsUnavailable resuming after a restart, got: %v", err)
+	}
+
+	other, err := newEventLog("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.epoch == "" || l.epoch == other.epoch {
+		t.Errorf("expected every in memory log to have its own epoch, got '%s' and '%s'", l.epoch, other.epoch)
+	}
+}
@@ -14,8 +14,12 @@ import (
 )
 
 type GRPCService struct {
-	lis *net.Listener
-	srv *grpc.Server
+	// Options configures the registrar server
+	Options ServerOptions
+
+	lis    *net.Listener
+	srv    *grpc.Server
+	server *Server
 }
 
 func (s *GRPCService) Run(ctx context.Context, log logrus.FieldLogger) error { //nolint:funlen
@@ -26,10 +30,11 @@ func (s *GRPCService) Run(ctx context.Context, log logrus.FieldLogger) error { /
 	}
 	s.lis = &l
 
-	server, err := NewServer(ctx)
+	server, err := NewServer(ctx, s.Options)
 	if err != nil {
 		return err
 	}
+	s.server = server
 
 	serverOpts := make([]grpc.ServerOption, 0)
 	if os.Getenv("REGISTRARD_ENABLE_TLS") != "" {
@@ -46,6 +51,10 @@ func (s *GRPCService) Run(ctx context.Context, log logrus.FieldLogger) error { /
 	s.srv = grpc.NewServer(serverOpts...)
 	api.RegisterRegistrarServer(s.srv, server)
 
+	if s.Options.ReadOnly {
+		log.Warn("Running in read-only mode, devices will not be registered or updated")
+	}
+
 	// Note: .Serve() blocks
 	log.Info("Serving GRPC Service on " + listAddr)
 	if err := s.srv.Serve(l); err != nil {
@@ -57,11 +66,20 @@ func (s *GRPCService) Run(ctx context.Context, log logrus.FieldLogger) error { /
 }
 
 func (s *GRPCService) Close() error {
+	// event streams never end on their own, so they have to be stopped
+	// before the grpc server can stop gracefully
+	if s.server != nil {
+		if err := s.server.Close(); err != nil {
+			log.WithError(err).Warn("failed to close event log")
+		}
+	}
 	if s.srv != nil {
 		s.srv.GracefulStop()
 	}
 	if s.lis != nil {
-		return (*s.lis).Close()
+		if err := (*s.lis).Close(); err != nil {
+			return err
+		}
 	}
 	log.Infof("grpc service shutdown")
 	return nil
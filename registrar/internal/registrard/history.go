@@ -0,0 +1,46 @@
+package registrard
+
+import (
+	"context"
+	"net"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"google.golang.org/grpc/peer"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxDeviceHistory is the number of events kept in a device's history
+const maxDeviceHistory = 25
+
+// recordEvent adds an event to a device's history, dropping the oldest
+// events once there are more than maxDeviceHistory. The recorded event is
+// returned so it can be published once the device is saved.
+func recordEvent(d *registrar.Device, t metav1.Time, reason, message string) registrar.DeviceEvent {
+	e := registrar.DeviceEvent{
+		Time:    t,
+		Reason:  reason,
+		Message: message,
+	}
+	d.Status.History = append(d.Status.History, e)
+
+	if over := len(d.Status.History) - maxDeviceHistory; over > 0 {
+		d.Status.History = d.Status.History[over:]
+	}
+
+	return e
+}
+
+// remoteHost returns the host a grpc request came from, without the port
+// as that changes on every connection
+func remoteHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,37 @@
+package registrard
+
+import (
+	"fmt"
+	"testing"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecordEvent(t *testing.T) {
+	d := &registrar.Device{}
+	now := metav1.Now()
+
+	for i := 0; i < maxDeviceHistory; i++ {
+		recordEvent(d, now, registrar.DeviceEventReregistered, fmt.Sprint(i))
+	}
+	if len(d.Status.History) != maxDeviceHistory {
+		t.Fatalf("expected %d events, got %d", maxDeviceHistory, len(d.Status.History))
+	}
+
+	e := recordEvent(d, now, registrar.DeviceEventRemoteAddrChanged, "latest")
+	if e.Reason != registrar.DeviceEventRemoteAddrChanged || e.Message != "latest" {
+		t.Errorf("expected the recorded event to be returned, got %v", e)
+	}
+
+	h := d.Status.History
+	if len(h) != maxDeviceHistory {
+		t.Fatalf("expected history to be trimmed to %d events, got %d", maxDeviceHistory, len(h))
+	}
+	if h[0].Message != "1" {
+		t.Errorf("expected the oldest event to be dropped, first event is '%s'", h[0].Message)
+	}
+	if h[len(h)-1].Message != "latest" {
+		t.Errorf("expected the newest event last, got '%s'", h[len(h)-1].Message)
+	}
+}
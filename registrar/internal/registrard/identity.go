@@ -0,0 +1,348 @@
+package registrard
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+)
+
+// identityVerifier verifies a cloud provider signed instance identity
+// and returns the ID of the instance it belongs to
+type identityVerifier interface {
+	Verify(ctx context.Context, id *api.InstanceIdentity) (string, error)
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(s string) map[string]bool {
+	l := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l[v] = true
+		}
+	}
+	return l
+}
+
+// awsIdentityVerifier verifies AWS EC2 instance identity documents
+type awsIdentityVerifier struct {
+	pub *rsa.PublicKey
+
+	// accounts are the only AWS accounts allowed to register
+	accounts map[string]bool
+
+	// maxAge, if set, is how long after an instance started its identity
+	// document is accepted for. Documents never expire, so otherwise a
+	// leaked document and signature can be replayed forever.
+	maxAge time.Duration
+}
+
+type awsIdentityDocument struct {
+	AccountID   string    `json:"accountId"`
+	InstanceID  string    `json:"instanceId"`
+	Region      string    `json:"region"`
+	PendingTime time.Time `json:"pendingTime"`
+}
+
+// newAWSIdentityVerifier creates a verifier from the PEM encoded AWS
+// certificate for the region(s) instances are running in
+func newAWSIdentityVerifier(certPath, accounts string, maxAge time.Duration) (*awsIdentityVerifier, error) {
+	allowed := splitList(accounts)
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("REGISTRARD_AWS_ACCOUNT_IDS must be set, otherwise any aws account can register")
+	}
+
+	b, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read aws identity certificate")
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode aws identity certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse aws identity certificate")
+	}
+
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("aws identity certificate is not an RSA certificate")
+	}
+
+	return &awsIdentityVerifier{pub: pub, accounts: allowed, maxAge: maxAge}, nil
+}
+
+func (v *awsIdentityVerifier) Verify(ctx context.Context, id *api.InstanceIdentity) (string, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(id.Signature))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode signature")
+	}
+
+	hash := sha256.Sum256([]byte(id.Document))
+	if err := rsa.VerifyPKCS1v15(v.pub, crypto.SHA256, hash[:], sig); err != nil {
+		return "", errors.Wrap(err, "invalid signature")
+	}
+
+	var doc awsIdentityDocument
+	if err := json.Unmarshal([]byte(id.Document), &doc); err != nil {
+		return "", errors.Wrap(err, "failed to parse identity document")
+	}
+
+	if !v.accounts[doc.AccountID] {
+		return "", fmt.Errorf("account '%s' is not allowed to register", doc.AccountID)
+	}
+
+	if v.maxAge != 0 && time.Since(doc.PendingTime) > v.maxAge {
+		return "", fmt.Errorf("identity document is from an instance started more than %s ago", v.maxAge)
+	}
+
+	if doc.InstanceID == "" {
+		return "", fmt.Errorf("identity document is missing an instance id")
+	}
+
+	return doc.InstanceID, nil
+}
+
+// gcpCertsURL serves the x509 certificates google signs identity tokens with
+const gcpCertsURL = "https://www.googleapis.com/oauth2/v1/certs"
+
+// gcpCertsMinRefresh is how often the google certificates can be
+// refetched because of an unknown key id
+const gcpCertsMinRefresh = time.Minute
+
+// gcpIdentityVerifier verifies GCE instance identity tokens
+type gcpIdentityVerifier struct {
+	h        *http.Client
+	certsURL string
+	audience string
+
+	// projects are the only GCP projects allowed to register
+	projects map[string]bool
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	keysFetch time.Time
+
+	// lastFetch is when the certificates were last fetched, successfully
+	// or not, and fetching is closed once an in progress fetch finishes
+	lastFetch time.Time
+	fetching  chan struct{}
+}
+
+type gcpIdentityClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Expires  int64  `json:"exp"`
+	Google   struct {
+		ComputeEngine struct {
+			ProjectID  string `json:"project_id"`
+			InstanceID string `json:"instance_id"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+func newGCPIdentityVerifier(audience, projects string) (*gcpIdentityVerifier, error) {
+	allowed := splitList(projects)
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("REGISTRARD_GCP_PROJECT_IDS must be set, otherwise any gcp project can register")
+	}
+
+	return &gcpIdentityVerifier{
+		h:        &http.Client{Timeout: 10 * time.Second},
+		certsURL: gcpCertsURL,
+		audience: audience,
+		projects: allowed,
+	}, nil
+}
+
+// getKey returns the public key for a key id, refreshing the google
+// certificates once an hour. Unknown key ids only cause a refresh once
+// every gcpCertsMinRefresh, as tokens are checked before a device is
+// authenticated.
+func (v *gcpIdentityVerifier) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	for {
+		if k, ok := v.keys[kid]; ok && time.Since(v.keysFetch) < time.Hour {
+			v.mu.Unlock()
+			return k, nil
+		}
+
+		if v.fetching == nil {
+			break
+		}
+
+		// wait for the in progress fetch instead of starting another one
+		fetching := v.fetching
+		v.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+	}
+
+	k, ok := v.keys[kid]
+	if time.Since(v.lastFetch) < gcpCertsMinRefresh {
+		v.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key '%s'", kid)
+		}
+		return k, nil
+	}
+
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.lastFetch = time.Now()
+	v.mu.Unlock()
+
+	keys, err := v.fetchKeys(ctx)
+
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+		v.keysFetch = time.Now()
+	}
+	k, ok = v.keys[kid]
+	v.fetching = nil
+	close(fetching)
+	v.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return k, nil
+}
+
+// fetchKeys fetches the public keys google signs identity tokens with
+func (v *gcpIdentityVerifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.certsURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := v.h.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch google certificates")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got non 200 status code %d fetching google certificates", resp.StatusCode)
+	}
+
+	var certs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse google certificates")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for id, c := range certs {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			keys[id] = pub
+		}
+	}
+
+	return keys, nil
+}
+
+func (v *gcpIdentityVerifier) Verify(ctx context.Context, id *api.InstanceIdentity) (string, error) {
+	parts := strings.Split(id.Document, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("identity token is not a JWT")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode token header")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return "", errors.Wrap(err, "failed to parse token header")
+	}
+
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported token algorithm '%s'", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode token signature")
+	}
+
+	pub, err := v.getKey(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig); err != nil {
+		return "", errors.Wrap(err, "invalid signature")
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode token claims")
+	}
+
+	var claims gcpIdentityClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return "", errors.Wrap(err, "failed to parse token claims")
+	}
+
+	if claims.Issuer != "https://accounts.google.com" && claims.Issuer != "accounts.google.com" {
+		return "", fmt.Errorf("unexpected token issuer '%s'", claims.Issuer)
+	}
+
+	if claims.Audience != v.audience {
+		return "", fmt.Errorf("unexpected token audience '%s'", claims.Audience)
+	}
+
+	if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return "", fmt.Errorf("identity token has expired")
+	}
+
+	gce := claims.Google.ComputeEngine
+	if !v.projects[gce.ProjectID] {
+		return "", fmt.Errorf("project '%s' is not allowed to register", gce.ProjectID)
+	}
+
+	if gce.InstanceID == "" {
+		return "", fmt.Errorf("identity token is missing an instance id, was it requested with format=full?")
+	}
+
+	return gce.InstanceID, nil
+}
@@ -0,0 +1,166 @@
+package registrard
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+)
+
+func TestAWSIdentityVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(doc string) string {
+		hash := sha256.Sum256([]byte(doc))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+
+	v := &awsIdentityVerifier{pub: &key.PublicKey, accounts: splitList("123456789012")}
+	doc := `{"accountId":"123456789012","instanceId":"i-0abc","region":"us-west-2"}`
+
+	id, err := v.Verify(context.Background(), &api.InstanceIdentity{Provider: "aws", Document: doc, Signature: sign(doc)})
+	if err != nil {
+		t.Fatalf("expected valid identity, got: %v", err)
+	}
+	if id != "i-0abc" {
+		t.Errorf("expected instance id 'i-0abc', got '%s'", id)
+	}
+
+	tampered := `{"accountId":"123456789012","instanceId":"i-0def","region":"us-west-2"}`
+	if _, err := v.Verify(context.Background(), &api.InstanceIdentity{Provider: "aws", Document: tampered, Signature: sign(doc)}); err == nil {
+		t.Error("expected tampered document to be rejected")
+	}
+
+	otherAccount := `{"accountId":"210987654321","instanceId":"i-0abc","region":"us-west-2"}`
+	if _, err := v.Verify(context.Background(), &api.InstanceIdentity{Provider: "aws", Document: otherAccount, Signature: sign(otherAccount)}); err == nil {
+		t.Error("expected document from a disallowed account to be rejected")
+	}
+
+	v.maxAge = time.Hour
+	old := fmt.Sprintf(`{"accountId":"123456789012","instanceId":"i-0abc","pendingTime":"%s"}`,
+		time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339))
+	if _, err := v.Verify(context.Background(), &api.InstanceIdentity{Provider: "aws", Document: old, Signature: sign(old)}); err == nil {
+		t.Error("expected document from an instance started before the max age to be rejected")
+	}
+
+	fresh := fmt.Sprintf(`{"accountId":"123456789012","instanceId":"i-0abc","pendingTime":"%s"}`,
+		time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	if _, err := v.Verify(context.Background(), &api.InstanceIdentity{Provider: "aws", Document: fresh, Signature: sign(fresh)}); err != nil {
+		t.Errorf("expected document from a recently started instance to be accepted, got: %v", err)
+	}
+}
+
+func TestGCPIdentityVerifier(t *testing.T) { //nolint:funlen
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := json.Marshal(map[string]string{
+		"key-1": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(certs) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	sign := func(kid, claims string) string {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"RS256","kid":"%s"}`, kid))) +
+			"." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+		hash := sha256.Sum256([]byte(payload))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	claims := func(aud, project string, exp time.Time) string {
+		return fmt.Sprintf(`{"iss":"https://accounts.google.com","aud":"%s","exp":%d,`+
+			`"google":{"compute_engine":{"project_id":"%s","instance_id":"1234"}}}`, aud, exp.Unix(), project)
+	}
+
+	if _, err := newGCPIdentityVerifier("registrard", ""); err == nil {
+		t.Error("expected a verifier without allowed projects to be rejected")
+	}
+
+	v, err := newGCPIdentityVerifier("registrard", "my-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.certsURL = srv.URL
+	verify := func(token string) (string, error) {
+		return v.Verify(context.Background(), &api.InstanceIdentity{Provider: "gcp", Document: token})
+	}
+	expires := time.Now().Add(time.Hour)
+
+	id, err := verify(sign("key-1", claims("registrard", "my-project", expires)))
+	if err != nil {
+		t.Fatalf("expected valid identity, got: %v", err)
+	}
+	if id != "1234" {
+		t.Errorf("expected instance id '1234', got '%s'", id)
+	}
+
+	if _, err := verify(sign("key-1", claims("someone-else", "my-project", expires))); err == nil {
+		t.Error("expected token for another audience to be rejected")
+	}
+
+	if _, err := verify(sign("key-1", claims("registrard", "other-project", expires))); err == nil {
+		t.Error("expected token from a disallowed project to be rejected")
+	}
+
+	if _, err := verify(sign("key-1", claims("registrard", "my-project", time.Now().Add(-time.Minute)))); err == nil {
+		t.Error("expected expired token to be rejected")
+	}
+
+	tampered := sign("key-1", claims("registrard", "my-project", expires))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	if _, err := verify(tampered); err == nil {
+		t.Error("expected token with an invalid signature to be rejected")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := verify(sign("unknown", claims("registrard", "my-project", expires))); err == nil {
+			t.Error("expected token signed with an unknown key to be rejected")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected certificates to be fetched once, got %d fetches", n)
+	}
+}
@@ -0,0 +1,176 @@
+package registrard
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// provisionData is passed to provisioning templates
+type provisionData struct {
+	// Name is the name of the device
+	Name string
+
+	// ID is the UID of the device, as returned to the device
+	ID string
+
+	// Namespace is the namespace of the device
+	Namespace string
+
+	// Labels are the labels of the device
+	Labels map[string]string
+}
+
+// provisioner creates operator defined resources for every registered
+// device from a directory of templates
+type provisioner struct {
+	c         client.Client
+	mapper    meta.RESTMapper
+	templates []*template.Template
+}
+
+// newProvisioner parses all *.yaml templates in dir. Each template is a
+// text/template rendered with provisionData, and may contain multiple
+// YAML documents.
+func newProvisioner(conf *rest.Config, dir string) (*provisioner, error) {
+	templates, err := parseProvisionTemplates(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &provisioner{templates: templates}
+	p.mapper, err = apiutil.NewDynamicRESTMapper(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create rest mapper")
+	}
+
+	p.c, err = client.New(conf, client.Options{Mapper: p.mapper})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes client")
+	}
+
+	return p, nil
+}
+
+// parseProvisionTemplates parses all *.yaml templates in dir, in order
+func parseProvisionTemplates(dir string) ([]*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list provisioning templates")
+	}
+	sort.Strings(files)
+
+	templates := make([]*template.Template, 0, len(files))
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read provisioning template '%s'", f)
+		}
+
+		t, err := template.New(filepath.Base(f)).Option("missingkey=error").Parse(string(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse provisioning template '%s'", f)
+		}
+		templates = append(templates, t)
+	}
+
+	return templates, nil
+}
+
+// render renders all templates for a device into objects
+func (p *provisioner) render(d *registrar.Device) ([]*unstructured.Unstructured, error) {
+	data := provisionData{
+		Name:      d.Name,
+		ID:        string(d.UID),
+		Namespace: d.Namespace,
+		Labels:    d.Labels,
+	}
+
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, t := range p.templates {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(err, "failed to render provisioning template '%s'", t.Name())
+		}
+
+		dec := utilyaml.NewYAMLOrJSONDecoder(&buf, 4096)
+		for {
+			obj := &unstructured.Unstructured{}
+			if err := dec.Decode(&obj.Object); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode provisioning template '%s'", t.Name())
+			}
+
+			// skip empty documents
+			if len(obj.Object) == 0 {
+				continue
+			}
+			objs = append(objs, obj)
+		}
+	}
+
+	return objs, nil
+}
+
+// Provision creates all templated resources for a device. Resources
+// that already exist are left alone, so this is safe to call on every
+// registration.
+func (p *provisioner) Provision(ctx context.Context, d *registrar.Device) error {
+	objs, err := p.render(d)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		mapping, err := p.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find resource for '%s'", gvk)
+		}
+
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			if obj.GetNamespace() == "" {
+				obj.SetNamespace(d.Namespace)
+			}
+
+			// tie the lifetime of resources in the device's namespace
+			// to the device
+			if obj.GetNamespace() == d.Namespace {
+				obj.SetOwnerReferences(append(obj.GetOwnerReferences(), metav1.OwnerReference{
+					APIVersion: registrar.GroupVersion.String(),
+					Kind:       "Device",
+					Name:       d.Name,
+					UID:        d.UID,
+				}))
+			}
+		}
+
+		err = p.c.Create(ctx, obj)
+		if kerrors.IsAlreadyExists(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to create %s '%s'", gvk.Kind, obj.GetName())
+		}
+
+		log.Infof("provisioned %s '%s' for device '%s'", gvk.Kind, obj.GetName(), d.Name)
+	}
+
+	return nil
+}
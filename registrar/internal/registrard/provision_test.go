@@ -0,0 +1,159 @@
+package registrard
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestProvisioner creates a provisioner from templates, keyed by file
+// name, using a fake client that knows about Secrets and Namespaces
+func newTestProvisioner(t *testing.T, templates map[string]string) *provisioner {
+	dir, err := ioutil.TempDir("", "registrar-provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, tmpl := range templates {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(tmpl), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &provisioner{c: fake.NewFakeClientWithScheme(scheme.Scheme)}
+	p.templates, err = parseProvisionTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	p.mapper = mapper
+
+	return p
+}
+
+var testDevice = &registrar.Device{
+	ObjectMeta: metav1.ObjectMeta{
+		Name:      "device",
+		Namespace: "registrar",
+		UID:       types.UID("1234"),
+		Labels:    map[string]string{"site": "home"},
+	},
+}
+
+func TestProvisionerRender(t *testing.T) {
+	p := newTestProvisioner(t, map[string]string{
+		"a.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: "{{ .Name }}-a"
+  labels:
+    site: "{{ .Labels.site }}"
+stringData:
+  id: "{{ .ID }}"
+---
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: "{{ .Name }}-b"
+  namespace: "{{ .Namespace }}"
+`,
+		"b.yaml": "",
+	})
+
+	objs, err := p.render(testDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("expected 2 objects with empty documents skipped, got %d", len(objs))
+	}
+	if objs[0].GetName() != "device-a" || objs[0].GetLabels()["site"] != "home" {
+		t.Errorf("expected templated name and labels, got %v", objs[0].Object)
+	}
+	if id, _, _ := unstructured.NestedString(objs[0].Object, "stringData", "id"); id != "1234" {
+		t.Errorf("expected templated id '1234', got '%s'", id)
+	}
+	if objs[1].GetNamespace() != "registrar" {
+		t.Errorf("expected templated namespace 'registrar', got '%s'", objs[1].GetNamespace())
+	}
+
+	p = newTestProvisioner(t, map[string]string{
+		"missing.yaml": "metadata:\n  name: \"{{ .Labels.missing }}\"\n",
+	})
+	if _, err := p.render(testDevice); err == nil {
+		t.Error("expected a template using a missing key to fail")
+	}
+}
+
+func TestProvisionerProvision(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProvisioner(t, map[string]string{
+		"secrets.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: "{{ .Name }}"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: "{{ .Name }}"
+  namespace: other
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: "{{ .Name }}"
+`,
+	})
+
+	if err := p.Provision(ctx, testDevice); err != nil {
+		t.Fatal(err)
+	}
+
+	// provisioning again leaves existing resources alone
+	if err := p.Provision(ctx, testDevice); err != nil {
+		t.Fatalf("expected provisioning to be repeatable, got: %v", err)
+	}
+
+	var owned corev1.Secret
+	if err := p.c.Get(ctx, client.ObjectKey{Namespace: "registrar", Name: "device"}, &owned); err != nil {
+		t.Fatalf("expected secret to default to the device's namespace, got: %v", err)
+	}
+	if refs := owned.OwnerReferences; len(refs) != 1 || refs[0].Kind != "Device" || refs[0].UID != testDevice.UID {
+		t.Errorf("expected secret to be owned by the device, got %v", refs)
+	}
+
+	var other corev1.Secret
+	if err := p.c.Get(ctx, client.ObjectKey{Namespace: "other", Name: "device"}, &other); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.OwnerReferences) != 0 {
+		t.Errorf("expected secret in another namespace to not be owned by the device, got %v", other.OwnerReferences)
+	}
+
+	var ns corev1.Namespace
+	if err := p.c.Get(ctx, client.ObjectKey{Name: "device"}, &ns); err != nil {
+		t.Fatal(err)
+	}
+	if ns.Namespace != "" || len(ns.OwnerReferences) != 0 {
+		t.Errorf("expected cluster scoped resource to not get a namespace or owner, got %v", ns.ObjectMeta)
+	}
+}
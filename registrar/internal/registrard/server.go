@@ -9,16 +9,21 @@ import (
 	"crypto/subtle"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/blang/semver/v4"
 	"github.com/google/uuid"
 	"github.com/jaredallard-home/worker-nodes/registrar/api"
-	"github.com/jaredallard-home/worker-nodes/registrar/apis/clientset/v1alpha1"
 	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
 	"github.com/jaredallard-home/worker-nodes/registrar/internal/kube"
+	"github.com/jaredallard-home/worker-nodes/registrar/internal/storage"
 	"github.com/jaredallard-home/worker-nodes/registrar/pkg/rancher"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -29,82 +34,441 @@ var (
 
 // Server is the actual server implementation of the API.
 type Server struct {
-	k            *v1alpha1.RegistrarClientset
+	opts         ServerOptions
+	devices      storage.Store
 	r            *rancher.Client
 	authToken    []byte
 	authTokenlen int32
+
+	// identities are the cloud instance identity verifiers, keyed by
+	// provider, that devices can register with instead of authToken
+	identities map[string]identityVerifier
+
+	// approval, if set, must approve new devices before they are registered
+	approval *approvalWebhook
+
+	// provisioner, if set, creates templated resources for registered devices
+	provisioner *provisioner
+
+	// minAgentVersion, if set, is the oldest agent version allowed to register
+	minAgentVersion *semver.Version
+
+	// damper, if set, holds down devices that register too often
+	damper *damper
+
+	// events is the log of device lifecycle events streamed by Events
+	events *eventLog
+}
+
+// ServerOptions configures a Server
+type ServerOptions struct {
+	// ReadOnly refuses all mutations. Registered devices can still fetch
+	// their registration information, but new devices are rejected and
+	// existing devices are not updated.
+	ReadOnly bool
 }
 
 // NewServer creates a new grpc server interface
-func NewServer(ctx context.Context) (*Server, error) {
-	s := &Server{}
-	c, err := kube.New()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create kube config")
+func NewServer(ctx context.Context, opts ServerOptions) (*Server, error) {
+	s := &Server{opts: opts}
+	s.r = rancher.NewClient(os.Getenv("RANCHER_HOST"), os.Getenv("RANCHER_TOKEN"))
+
+	// prefer an explicitly configured namespace, then the namespace we're
+	// running in (via the downward API)
+	namespace := os.Getenv("REGISTRARD_NAMESPACE")
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		namespace = "registrar"
 	}
 
-	s.r = rancher.NewClient(os.Getenv("RANCHER_HOST"), os.Getenv("RANCHER_TOKEN"))
+	storageOpts := storage.Options{
+		Backend:   os.Getenv("REGISTRARD_STORAGE"),
+		Namespace: namespace,
+		Path:      os.Getenv("REGISTRARD_STORAGE_PATH"),
+	}
 
-	s.k, err = v1alpha1.NewForConfig(c)
+	var err error
+	s.devices, err = storage.New(storageOpts)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create kubernetes and registrar clientset")
+		return nil, errors.Wrap(err, "failed to create device storage")
 	}
 
 	s.authToken = []byte(os.Getenv("REGISTRARD_TOKEN"))
 	s.authTokenlen = int32(len(s.authToken))
+
+	s.identities = make(map[string]identityVerifier)
+	if certPath := os.Getenv("REGISTRARD_AWS_IDENTITY_CERT"); certPath != "" {
+		var maxAge time.Duration
+		if v := os.Getenv("REGISTRARD_AWS_IDENTITY_MAX_AGE"); v != "" {
+			maxAge, err = time.ParseDuration(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse aws identity max age")
+			}
+		}
+
+		v, err := newAWSIdentityVerifier(certPath, os.Getenv("REGISTRARD_AWS_ACCOUNT_IDS"), maxAge)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to setup aws instance identity")
+		}
+		s.identities["aws"] = v
+	}
+	if audience := os.Getenv("REGISTRARD_GCP_IDENTITY_AUDIENCE"); audience != "" {
+		v, err := newGCPIdentityVerifier(audience, os.Getenv("REGISTRARD_GCP_PROJECT_IDS"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to setup gcp instance identity")
+		}
+		s.identities["gcp"] = v
+	}
+
+	if s.authTokenlen == 0 && len(s.identities) == 0 {
+		return nil, fmt.Errorf("REGISTRARD_TOKEN or a cloud instance identity provider must be configured")
+	}
+
+	if u := os.Getenv("REGISTRARD_APPROVAL_WEBHOOK_URL"); u != "" {
+		s.approval = newApprovalWebhook(u, os.Getenv("REGISTRARD_APPROVAL_WEBHOOK_TOKEN"))
+	}
+
+	if dir := os.Getenv("REGISTRARD_PROVISION_TEMPLATES_DIR"); dir != "" {
+		if storageOpts.Backend != "" && storageOpts.Backend != "kube" {
+			return nil, fmt.Errorf("provisioning templates require the kube storage backend")
+		}
+
+		c, err := kube.New()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create kube config")
+		}
+
+		s.provisioner, err = newProvisioner(c, dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to setup provisioning")
+		}
+	}
+
+	if v := os.Getenv("REGISTRARD_MIN_AGENT_VERSION"); v != "" {
+		minVersion, err := semver.ParseTolerant(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse minimum agent version")
+		}
+		s.minAgentVersion = &minVersion
+	}
+
+	dampingThreshold := 5
+	if v := os.Getenv("REGISTRARD_DAMPING_THRESHOLD"); v != "" {
+		dampingThreshold, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse damping threshold")
+		}
+	}
+	if dampingThreshold > 0 {
+		s.damper = newDamper(dampingThreshold, 5*time.Minute)
+	}
+
+	eventsRetention := 10000
+	if v := os.Getenv("REGISTRARD_EVENTS_RETENTION"); v != "" {
+		eventsRetention, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse events retention")
+		}
+	}
+	s.events, err = newEventLog(os.Getenv("REGISTRARD_EVENTS_PATH"), eventsRetention)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup event log")
+	}
+
 	return s, err
 }
 
-func (s *Server) createDevice(ctx context.Context, namespace string, r *api.RegisterRequest) error {
-	// device doesn't exist, create it
-	_, err := s.k.RegistrarV1Alpha1Client().Devices(namespace).Create(ctx, &registrar.Device{
+// Close stops streaming events and closes the event log
+func (s *Server) Close() error {
+	return s.events.Close()
+}
+
+// damp marks a device as held down until a given time
+func (s *Server) damp(ctx context.Context, id string, until time.Time) error {
+	d, err := s.devices.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	now := metav1.Now()
+	dampedUntil := metav1.NewTime(until)
+	d.Status.DampedUntil = &dampedUntil
+	e := recordEvent(d, now, registrar.DeviceEventDamped, fmt.Sprintf(
+		"registered more than %d times in %s, refusing registrations for %s",
+		s.damper.threshold, s.damper.window, until.Sub(now.Time).Round(time.Second),
+	))
+
+	if _, err := s.devices.Update(ctx, d); err != nil {
+		return err
+	}
+
+	s.publish(id, e)
+	return nil
+}
+
+// publish adds events about a device to the event stream. Events are only
+// published after they've been saved to the device, so failing to publish
+// them doesn't fail the change and the events are lost.
+func (s *Server) publish(id string, events ...registrar.DeviceEvent) {
+	if err := s.events.Publish(id, events...); err != nil {
+		log.WithError(err).Errorf("failed to publish events for device '%s'", id)
+	}
+}
+
+// flagOutdated marks an existing device as outdated after its agent was
+// refused for being older than the minimum agent version
+func (s *Server) flagOutdated(ctx context.Context, id string, reason error) error {
+	d, err := s.devices.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// agents retry constantly, only record the first refusal
+	if d.Status.Outdated {
+		return nil
+	}
+
+	d.Status.Outdated = true
+	e := recordEvent(d, metav1.Now(), registrar.DeviceEventOutdated, reason.Error())
+
+	if _, err := s.devices.Update(ctx, d); err != nil {
+		return err
+	}
+
+	s.publish(id, e)
+	return nil
+}
+
+// checkAgentVersion ensures that an agent is at least the minimum
+// allowed version, if one is set
+func (s *Server) checkAgentVersion(agentVersion string) error {
+	if s.minAgentVersion == nil {
+		return nil
+	}
+
+	v, err := semver.ParseTolerant(agentVersion)
+	if err != nil {
+		return fmt.Errorf("agent version '%s' is invalid, registrard requires at least %s", agentVersion, s.minAgentVersion)
+	}
+
+	if v.LT(*s.minAgentVersion) {
+		return fmt.Errorf("agent version %s is too old, registrard requires at least %s", v, s.minAgentVersion)
+	}
+
+	return nil
+}
+
+// authenticate checks that a request has either a valid auth token or a
+// valid cloud instance identity. When an identity is used, the ID of the
+// instance is returned.
+func (s *Server) authenticate(ctx context.Context, r *api.RegisterRequest) (string, error) {
+	if id := r.InstanceIdentity; id != nil {
+		v, ok := s.identities[id.Provider]
+		if !ok {
+			return "", fmt.Errorf("instance identity provider '%s' is not enabled", id.Provider)
+		}
+
+		instanceID, err := v.Verify(ctx, id)
+		if err != nil {
+			log.WithError(err).Warnf("rejecting invalid %s instance identity", id.Provider)
+			return "", fmt.Errorf("invalid instance identity")
+		}
+		return instanceID, nil
+	}
+
+	return "", s.checkAuthToken(r.AuthToken)
+}
+
+// checkAuthToken checks that an auth token is valid. Token auth is
+// disabled when no token is configured.
+func (s *Server) checkAuthToken(token string) error {
+	if s.authTokenlen == 0 {
+		return fmt.Errorf("invalid auth token")
+	}
+
+	userTokenByte := []byte(token)
+
+	// we need to check if the auth token is the correct length
+	if subtle.ConstantTimeEq(s.authTokenlen, int32(len(userTokenByte))) == 0 {
+		return fmt.Errorf("invalid auth token")
+	}
+
+	// we need to check if the token is actually valid
+	if subtle.ConstantTimeCompare(s.authToken, userTokenByte) == 0 {
+		return fmt.Errorf("invalid auth token")
+	}
+
+	return nil
+}
+
+func (s *Server) createDevice(ctx context.Context, r *api.RegisterRequest) error {
+	now := metav1.Now()
+	d := &registrar.Device{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: r.Id,
 		},
-		Spec: registrar.DeviceSpec{},
+		Spec: registrar.DeviceSpec{
+			Owner:   r.Owner,
+			Contact: r.Contact,
+		},
 		Status: registrar.DeviceStatus{
-			Registered: true,
+			Registered:   true,
+			LastSeen:     &now,
+			AgentVersion: r.AgentVersion,
+			RemoteAddr:   remoteHost(ctx),
 		},
-	}, metav1.CreateOptions{})
+	}
+	e := recordEvent(d, now, registrar.DeviceEventRegistered, fmt.Sprintf("registered from %s", d.Status.RemoteAddr))
+
+	// device doesn't exist, create it
+	_, err := s.devices.Create(ctx, d)
 	if err != nil {
 		return errors.Wrap(err, "failed to create device")
 	}
 
+	s.publish(d.Name, e)
+	return nil
+}
+
+// updateDevice updates an existing device after it has re-registered
+func (s *Server) updateDevice(ctx context.Context, d *registrar.Device, r *api.RegisterRequest) error {
+	now := metav1.Now()
+
+	msg := "re-registered"
+	if d.Status.LastSeen != nil {
+		msg = fmt.Sprintf("re-registered after %s", now.Sub(d.Status.LastSeen.Time).Round(time.Second))
+	}
+	events := []registrar.DeviceEvent{recordEvent(d, now, registrar.DeviceEventReregistered, msg)}
+
+	// devices registered before remote addresses were recorded don't have
+	// one, which isn't a change
+	if addr := remoteHost(ctx); addr != d.Status.RemoteAddr {
+		if d.Status.RemoteAddr != "" {
+			events = append(events, recordEvent(d, now, registrar.DeviceEventRemoteAddrChanged,
+				fmt.Sprintf("remote address changed from %s to %s", d.Status.RemoteAddr, addr)))
+		}
+		d.Status.RemoteAddr = addr
+	}
+
+	d.Status.LastSeen = &now
+	d.Status.AgentVersion = r.AgentVersion
+	d.Status.Outdated = false
+	d.Status.DampedUntil = nil
+
+	// only overwrite ownership when the agent was configured with it, so
+	// it can also be managed on the Device directly
+	if r.Owner != "" {
+		d.Spec.Owner = r.Owner
+	}
+	if r.Contact != "" {
+		d.Spec.Contact = r.Contact
+	}
+
+	if _, err := s.devices.Update(ctx, d); err != nil {
+		return errors.Wrap(err, "failed to update device")
+	}
+
+	s.publish(d.Name, events...)
 	return nil
 }
 
 // Register registers a new device into the wireguard network.
 // TODO(jaredallard): GC when peer is not added fully
 func (s *Server) Register(ctx context.Context, r *api.RegisterRequest) (*api.RegisterResponse, error) {
-	namespace := "registrar"
-	userTokenByte := []byte(r.AuthToken)
-
-	// we need to check if the auth token is the correct length
-	if subtle.ConstantTimeEq(s.authTokenlen, int32(len(userTokenByte))) == 0 {
-		return nil, fmt.Errorf("invalid auth token")
+	instanceID, err := s.authenticate(ctx, r)
+	if err != nil {
+		return nil, err
 	}
 
-	// we need to check if the token is actually valid
-	if subtle.ConstantTimeCompare(s.authToken, userTokenByte) == 0 {
-		return nil, fmt.Errorf("invalid auth token")
+	// devices that don't send an ID get a new one on every registration,
+	// so they're damped by the address they register from instead
+	dampKey := r.Id
+	if dampKey == "" && instanceID == "" {
+		if addr := remoteHost(ctx); addr != "" {
+			dampKey = "addr:" + addr
+		}
 	}
 
-	if r.Id == "" {
+	if instanceID != "" {
+		// cloud instances are always identified by their verified instance
+		// ID, so an instance can't register as any other device
+		id := strings.ToLower(r.InstanceIdentity.Provider + "-" + instanceID)
+		if r.Id != "" && r.Id != id {
+			log.Warnf("rejecting instance '%s' registering as device '%s'", id, r.Id)
+			return nil, fmt.Errorf("device id does not match instance identity")
+		}
+		r.Id = id
+	} else if r.Id == "" {
 		// generate a new UUID for this device
 		r.Id = uuid.New().String()
 	}
+	if dampKey == "" {
+		dampKey = r.Id
+	}
+
+	if s.damper != nil {
+		if until, started := s.damper.Allow(dampKey); !until.IsZero() {
+			if started {
+				log.Warnf("device '%s' is registering too often, holding it down until %s", dampKey, until.Format(time.RFC3339))
+				if !s.opts.ReadOnly {
+					if err := s.damp(ctx, r.Id, until); err != nil && !errors.Is(err, storage.ErrNotFound) {
+						log.WithError(err).Warnf("failed to record hold down for device '%s'", r.Id)
+					}
+				}
+			}
+			return nil, fmt.Errorf("device is registering too often, try again after %s", until.Format(time.RFC3339))
+		}
+	}
+
+	// checked after damping so outdated agents retrying in a loop are held
+	// down too
+	if err := s.checkAgentVersion(r.AgentVersion); err != nil {
+		log.WithError(err).Warnf("rejecting registration of device '%s'", r.Id)
+		if !s.opts.ReadOnly {
+			if err := s.flagOutdated(ctx, r.Id, err); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.WithError(err).Warnf("failed to mark device '%s' as outdated", r.Id)
+			}
+		}
+		return nil, err
+	}
 
 	log.Infof("attempting to register device '%s'", r.Id)
 	resp := &api.RegisterResponse{
 		Id: r.Id,
 	}
 
-	_, err := s.k.RegistrarV1Alpha1Client().Devices(namespace).Get(ctx, r.Id, metav1.GetOptions{})
+	existing, err := s.devices.Get(ctx, r.Id)
 	if err == nil {
 		log.Infof("device '%s' already exists, returning registration information ...", r.Id)
-	} else if kerrors.IsNotFound(err) {
+		if !s.opts.ReadOnly {
+			if err := s.updateDevice(ctx, existing, r); err != nil {
+				return nil, err
+			}
+		}
+	} else if errors.Is(err, storage.ErrNotFound) {
+		if s.opts.ReadOnly {
+			log.Warnf("refusing to register new device '%s' in read-only mode", r.Id)
+			return nil, fmt.Errorf("registrard is in read-only mode, new devices can not be registered")
+		}
+
 		log.Infof("device '%s' is new, registering ...", r.Id)
-		if err := s.createDevice(ctx, namespace, r); err != nil {
+		if s.approval != nil {
+			if err := s.approval.Approve(ctx, r); err != nil {
+				log.WithError(err).Warnf("device '%s' was not approved", r.Id)
+
+				// only pass on reasons from the webhook, other failures could
+				// contain details about it
+				var denied *approvalDenied
+				if errors.As(err, &denied) {
+					return nil, errors.Wrap(err, "device was not approved")
+				}
+				return nil, fmt.Errorf("device was not approved")
+			}
+		}
+
+		if err := s.createDevice(ctx, r); err != nil {
 			return nil, errors.Wrap(err, "failed to register device")
 		}
 	} else if err != nil {
@@ -112,14 +476,56 @@ func (s *Server) Register(ctx context.Context, r *api.RegisterRequest) (*api.Reg
 		return nil, err
 	}
 
-	d, err := s.k.RegistrarV1Alpha1Client().Devices(namespace).Get(ctx, r.Id, metav1.GetOptions{})
+	d, err := s.devices.Get(ctx, r.Id)
 	if err != nil {
 		return nil, errors.New("failed to get device")
 	}
 
+	if s.provisioner != nil && !s.opts.ReadOnly {
+		if err := s.provisioner.Provision(ctx, d); err != nil {
+			return nil, errors.Wrap(err, "failed to provision device resources")
+		}
+	}
+
 	resp.Id = string(d.ObjectMeta.UID)
 	resp.ClusterToken = os.Getenv("CLUSTER_TOKEN")
 	resp.ClusterHost = os.Getenv("CLUSTER_HOST")
 
 	return resp, nil
 }
+
+// Events streams device lifecycle events. Consumers should persist the
+// epoch and sequence of the last event they've processed and resume from
+// them, which delivers every published event at most once, or fails with
+// OutOfRange if that's no longer possible. Events that fail to publish
+// after their change was saved are lost without using up a sequence.
+func (s *Server) Events(r *api.EventsRequest, stream api.Registrar_EventsServer) error {
+	if err := s.checkAuthToken(r.AuthToken); err != nil {
+		return err
+	}
+
+	after := r.AfterSequence
+	for {
+		events, changed, err := s.events.Since(r.Epoch, after)
+		if errors.Is(err, errEventsUnavailable) {
+			return status.Error(codes.OutOfRange, err.Error())
+		} else if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if err := stream.Send(e); err != nil {
+				return errors.Wrap(err, "failed to send event")
+			}
+			after = e.Sequence
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.events.Done():
+			return status.Error(codes.Unavailable, "registrard is shutting down")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package registrard
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blang/semver/v4"
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"github.com/jaredallard-home/worker-nodes/registrar/internal/storage"
+	"google.golang.org/grpc/peer"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestServer creates a server storing devices in a temporary directory
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "registrard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := storage.NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := newEventLog("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{devices: devices, events: events, authToken: []byte("token"), authTokenlen: 5}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestNewServerRequiresAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("REGISTRARD_STORAGE", "file")
+	os.Setenv("REGISTRARD_STORAGE_PATH", dir)
+	defer os.Unsetenv("REGISTRARD_STORAGE")
+	defer os.Unsetenv("REGISTRARD_STORAGE_PATH")
+
+	if _, err := NewServer(context.Background(), ServerOptions{}); err == nil {
+		t.Error("expected registrard to refuse to start without a token or identity provider")
+	}
+}
+
+func TestRegisterRejectsEmptyToken(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if _, err := s.Register(context.Background(), &api.RegisterRequest{Id: "device"}); err == nil {
+		t.Error("expected a registration without a token to be rejected")
+	}
+
+	// identity only registrards have no token, which must not let an
+	// empty token through
+	s.authToken, s.authTokenlen = nil, 0
+	if _, err := s.Register(context.Background(), &api.RegisterRequest{Id: "device"}); err == nil {
+		t.Error("expected an empty token to be rejected when no token is configured")
+	}
+	if err := s.checkAuthToken(""); err == nil {
+		t.Error("expected token auth to be disabled when no token is configured")
+	}
+
+	if _, err := s.devices.Get(context.Background(), "device"); err == nil {
+		t.Error("expected no device to be created")
+	}
+}
+
+func TestRegisterDampsDevicesWithoutAnID(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.damper = newDamper(2, 5*time.Minute)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+	})
+
+	// boot looping agents never send an ID, so every registration would
+	// be a new device
+	for i := 0; i < 2; i++ {
+		if _, err := s.Register(ctx, &api.RegisterRequest{AuthToken: "token"}); err != nil {
+			t.Fatalf("expected registration %d to succeed, got: %v", i+1, err)
+		}
+	}
+	if _, err := s.Register(ctx, &api.RegisterRequest{AuthToken: "token"}); err == nil {
+		t.Error("expected devices without an ID registering from the same address to be damped")
+	}
+
+	if _, err := s.Register(ctx, &api.RegisterRequest{Id: "named", AuthToken: "token"}); err != nil {
+		t.Errorf("expected a device with an ID to be damped separately, got: %v", err)
+	}
+}
+
+func TestCheckAgentVersion(t *testing.T) {
+	s := &Server{}
+	if err := s.checkAgentVersion("not-a-version"); err != nil {
+		t.Errorf("expected any version to be allowed without a minimum, got: %v", err)
+	}
+
+	minVersion := semver.MustParse("0.3.0")
+	s.minAgentVersion = &minVersion
+
+	tests := []struct {
+		version string
+		allowed bool
+	}{
+		{"v0.2.9", false},
+		{"v0.3.0-rc.1", false},
+		{"v0.3.0", true},
+		{"0.3.0", true},
+		{"v0.4.0", true},
+		{"v1.0.0", true},
+		{"", false},
+		{"not-a-version", false},
+	}
+
+	for _, tt := range tests {
+		err := s.checkAgentVersion(tt.version)
+		if tt.allowed && err != nil {
+			t.Errorf("expected agent version '%s' to be allowed, got: %v", tt.version, err)
+		} else if !tt.allowed && err == nil {
+			t.Errorf("expected agent version '%s' to be rejected", tt.version)
+		}
+	}
+}
+
+func TestRegisterDampsOutdatedAgents(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := s.Register(ctx, &api.RegisterRequest{Id: "device", AuthToken: "token", AgentVersion: "v0.1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	minVersion := semver.MustParse("0.2.0")
+	s.minAgentVersion = &minVersion
+	s.damper = newDamper(2, 5*time.Minute)
+
+	var err error
+	for i := 0; i < 3; i++ {
+		_, err = s.Register(ctx, &api.RegisterRequest{Id: "device", AuthToken: "token", AgentVersion: "v0.1.0"})
+		if err == nil {
+			t.Fatal("expected an outdated agent to be rejected")
+		}
+	}
+
+	d, getErr := s.devices.Get(ctx, "device")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if !d.Status.Outdated {
+		t.Error("expected device to be marked as outdated")
+	}
+	if d.Status.DampedUntil == nil {
+		t.Errorf("expected an outdated agent retrying in a loop to be held down, last error: %v", err)
+	}
+}
+
+func TestRegisterRecordsRemoteAddrChanges(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	from := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234},
+		})
+	}
+	addrChanges := func(name string) int {
+		d, err := s.devices.Get(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		for _, e := range d.Status.History {
+			if e.Reason == registrar.DeviceEventRemoteAddrChanged {
+				n++
+			}
+		}
+		return n
+	}
+
+	// devices registered before remote addresses were recorded
+	if _, err := s.devices.Create(context.Background(), &registrar.Device{
+		ObjectMeta: metav1.ObjectMeta{Name: "old"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register(from("10.0.0.2"), &api.RegisterRequest{Id: "old", AuthToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := addrChanges("old"); n != 0 {
+		t.Errorf("expected no address change for a device without a previous address, got %d", n)
+	}
+
+	if _, err := s.Register(from("10.0.0.1"), &api.RegisterRequest{Id: "device", AuthToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register(from("10.0.0.3"), &api.RegisterRequest{Id: "device", AuthToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := addrChanges("device"); n != 1 {
+		t.Errorf("expected an address change for a device registering from a new address, got %d", n)
+	}
+}
@@ -0,0 +1,122 @@
+package registrard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/peer"
+)
+
+// approvalRequest is the body sent to the approval webhook when a new
+// device attempts to register
+type approvalRequest struct {
+	// ID is the ID the device will be registered as
+	ID string `json:"id"`
+
+	// RemoteAddr is the address the registration came from
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	// InstanceProvider is set when the device authenticated using a
+	// cloud instance identity
+	InstanceProvider string `json:"instanceProvider,omitempty"`
+}
+
+// approvalResponse is the expected response from the approval webhook
+type approvalResponse struct {
+	// Allowed must be true for the device to be registered
+	Allowed bool `json:"allowed"`
+
+	// Reason is an optional explanation for denying a device
+	Reason string `json:"reason,omitempty"`
+}
+
+// approvalDenied is returned when the webhook answered that a device is
+// not allowed to register
+type approvalDenied struct {
+	Reason string
+}
+
+func (e *approvalDenied) Error() string {
+	return fmt.Sprintf("registration denied: %s", e.Reason)
+}
+
+// approvalWebhook asks an external system whether a new device is
+// allowed to register
+type approvalWebhook struct {
+	h     *http.Client
+	url   string
+	token string
+}
+
+func newApprovalWebhook(url, token string) *approvalWebhook {
+	return &approvalWebhook{
+		h:     &http.Client{Timeout: 10 * time.Second},
+		url:   url,
+		token: token,
+	}
+}
+
+// Approve returns nil if the webhook allowed the device to register. Any
+// failure to get an answer from the webhook is treated as a denial, only
+// an *approvalDenied error should be shown to the device.
+func (w *approvalWebhook) Approve(ctx context.Context, r *api.RegisterRequest) error { //nolint:funlen
+	body := approvalRequest{ID: r.Id}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		body.RemoteAddr = p.Addr.String()
+	}
+	if r.InstanceIdentity != nil {
+		body.InstanceProvider = r.InstanceIdentity.Provider
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode approval request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", w.token))
+	}
+
+	resp, err := w.h.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		if err != nil {
+			raw = []byte("failed to read body")
+		}
+		log.WithField("body", string(raw)).Warnf("approval webhook returned status code %d", resp.StatusCode)
+		return fmt.Errorf("got non 200 status code %d", resp.StatusCode)
+	}
+
+	var ar approvalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return errors.Wrap(err, "failed to parse body")
+	}
+
+	if !ar.Allowed {
+		if ar.Reason == "" {
+			ar.Reason = "no reason given"
+		}
+		return &approvalDenied{Reason: ar.Reason}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package registrard
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/api"
+	"github.com/pkg/errors"
+)
+
+func TestApprovalWebhook(t *testing.T) { //nolint:funlen
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		allowed bool
+		reason  string
+	}{
+		{
+			name: "allowed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				var req approvalRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID != "device" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if r.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"allowed":true}`)) //nolint:errcheck
+			},
+			allowed: true,
+		},
+		{
+			name: "denied with a reason",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"allowed":false,"reason":"unknown device"}`)) //nolint:errcheck
+			},
+			reason: "unknown device",
+		},
+		{
+			name: "denied without a reason",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{}`)) //nolint:errcheck
+			},
+			reason: "no reason given",
+		},
+		{
+			name: "non 200 status code",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"allowed":true}`)) //nolint:errcheck
+			},
+		},
+		{
+			name: "invalid json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`allowed`)) //nolint:errcheck
+			},
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte(`{"allowed":true}`)) //nolint:errcheck
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			w := newApprovalWebhook(srv.URL, "token")
+			w.h.Timeout = 50 * time.Millisecond
+
+			err := w.Approve(context.Background(), &api.RegisterRequest{Id: "device"})
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("expected device to be allowed, got: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected device to not be allowed")
+			}
+
+			var denied *approvalDenied
+			if tt.reason != "" && (!errors.As(err, &denied) || denied.Reason != tt.reason) {
+				t.Errorf("expected a denial with reason '%s', got: %v", tt.reason, err)
+			}
+			if tt.reason == "" && errors.As(err, &denied) {
+				t.Errorf("expected a failure to call the webhook, not a denial, got: %v", err)
+			}
+		})
+	}
+}
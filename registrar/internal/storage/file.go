@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// verify we satisfy the interface on compile time
+var (
+	_ Store = &File{}
+)
+
+// File stores devices as JSON files in a directory, for running
+// registrar without Kubernetes. It is only safe to use from a single
+// process.
+type File struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFile creates a store that keeps devices in dir, creating it if needed
+func NewFile(dir string) (*File, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("a path is required for file storage")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create storage directory")
+	}
+
+	return &File{dir: dir}, nil
+}
+
+// path returns the file a device is stored in, ensuring the name can't
+// escape the storage directory
+func (f *File) path(name string) (string, error) {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+		return "", fmt.Errorf("invalid device name '%s': %s", name, strings.Join(errs, ", "))
+	}
+	return filepath.Join(f.dir, name+".json"), nil
+}
+
+func (f *File) read(name string) (*registrar.Device, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read device")
+	}
+
+	var d registrar.Device
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse device '%s'", name)
+	}
+	return &d, nil
+}
+
+// write atomically writes a device to disk
+func (f *File) write(d *registrar.Device) error {
+	p, err := f.path(d.Name)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode device")
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write device")
+	}
+
+	return errors.Wrap(os.Rename(tmp, p), "failed to write device")
+}
+
+// Get returns a device by name
+func (f *File) Get(ctx context.Context, name string) (*registrar.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.read(name)
+}
+
+// List returns all devices, sorted by name
+func (f *File) List(ctx context.Context) ([]registrar.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+	sort.Strings(files)
+
+	devices := make([]registrar.Device, 0, len(files))
+	for _, file := range files {
+		d, err := f.read(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *d)
+	}
+
+	return devices, nil
+}
+
+// Create creates a device, filling in the metadata the API server
+// would otherwise set
+func (f *File) Create(ctx context.Context, d *registrar.Device) (*registrar.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.read(d.Name); err == nil {
+		return nil, ErrAlreadyExists
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	d = d.DeepCopy()
+	d.TypeMeta = metav1.TypeMeta{APIVersion: registrar.GroupVersion.String(), Kind: "Device"}
+	d.UID = types.UID(uuid.NewUUID())
+	d.CreationTimestamp = metav1.Now()
+	d.ResourceVersion = "1"
+
+	return d, f.write(d)
+}
+
+// Update updates an existing device
+func (f *File) Update(ctx context.Context, d *registrar.Device) (*registrar.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	existing, err := f.read(d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// metadata the API server owns can't be changed by an update
+	d = d.DeepCopy()
+	d.TypeMeta = existing.TypeMeta
+	d.UID = existing.UID
+	d.CreationTimestamp = existing.CreationTimestamp
+
+	rv, _ := strconv.Atoi(existing.ResourceVersion)
+	d.ResourceVersion = strconv.Itoa(rv + 1)
+
+	return d, f.write(d)
+}
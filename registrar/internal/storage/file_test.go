@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFile(t *testing.T) { //nolint:funlen
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "registrar-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Get(ctx, "device"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing device, got: %v", err)
+	}
+
+	created, err := f.Create(ctx, &registrar.Device{
+		ObjectMeta: metav1.ObjectMeta{Name: "device"},
+		Spec:       registrar.DeviceSpec{Owner: "jared"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.UID == "" {
+		t.Error("expected created device to be assigned a UID")
+	}
+
+	if _, err := f.Create(ctx, &registrar.Device{ObjectMeta: metav1.ObjectMeta{Name: "device"}}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists creating a duplicate device, got: %v", err)
+	}
+
+	created.Spec.Owner = "someone-else"
+	created.UID = "changed"
+	if _, err := f.Update(ctx, created); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := f.Get(ctx, "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Owner != "someone-else" {
+		t.Errorf("expected updated owner 'someone-else', got '%s'", d.Spec.Owner)
+	}
+	if d.UID == "changed" {
+		t.Error("expected update to not change the device's UID")
+	}
+
+	l, err := f.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].Name != "device" {
+		t.Errorf("expected to list exactly 'device', got %v", l)
+	}
+
+	if _, err := f.Get(ctx, "../escape"); err == nil {
+		t.Error("expected an invalid device name to be rejected")
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/apis/clientset/v1alpha1"
+	registrar "github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+	"github.com/jaredallard-home/worker-nodes/registrar/internal/kube"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// verify we satisfy the interface on compile time
+var (
+	_ Store = &Kube{}
+)
+
+// Kube stores devices as Device custom resources
+type Kube struct {
+	devices v1alpha1.DeviceInterface
+}
+
+// NewKube creates a store for devices in a namespace using the current
+// kube config
+func NewKube(namespace string) (*Kube, error) {
+	c, err := kube.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kube config")
+	}
+
+	k, err := v1alpha1.NewForConfig(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kubernetes and registrar clientset")
+	}
+
+	return &Kube{devices: k.RegistrarV1Alpha1Client().Devices(namespace)}, nil
+}
+
+// convertError converts kubernetes errors into storage errors
+func convertError(err error) error {
+	if kerrors.IsNotFound(err) {
+		return ErrNotFound
+	} else if kerrors.IsAlreadyExists(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// Get returns a device by name
+func (k *Kube) Get(ctx context.Context, name string) (*registrar.Device, error) {
+	d, err := k.devices.Get(ctx, name, metav1.GetOptions{})
+	return d, convertError(err)
+}
+
+// List returns all devices
+func (k *Kube) List(ctx context.Context) ([]registrar.Device, error) {
+	l, err := k.devices.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// Create creates a device
+func (k *Kube) Create(ctx context.Context, d *registrar.Device) (*registrar.Device, error) {
+	d, err := k.devices.Create(ctx, d, metav1.CreateOptions{})
+	return d, convertError(err)
+}
+
+// Update updates a device
+func (k *Kube) Update(ctx context.Context, d *registrar.Device) (*registrar.Device, error) {
+	d, err := k.devices.Update(ctx, d)
+	return d, convertError(err)
+}
@@ -0,0 +1,57 @@
+// Package storage persists registered devices.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jaredallard-home/worker-nodes/registrar/apis/types/v1alpha1"
+)
+
+var (
+	// ErrNotFound is returned when a device does not exist
+	ErrNotFound = errors.New("device not found")
+
+	// ErrAlreadyExists is returned when creating a device that already exists
+	ErrAlreadyExists = errors.New("device already exists")
+)
+
+// Store persists devices
+type Store interface {
+	// Get returns a device by name, or ErrNotFound if it doesn't exist
+	Get(ctx context.Context, name string) (*v1alpha1.Device, error)
+
+	// List returns all devices
+	List(ctx context.Context) ([]v1alpha1.Device, error)
+
+	// Create creates a new device, or returns ErrAlreadyExists
+	Create(ctx context.Context, d *v1alpha1.Device) (*v1alpha1.Device, error)
+
+	// Update updates an existing device
+	Update(ctx context.Context, d *v1alpha1.Device) (*v1alpha1.Device, error)
+}
+
+// Options configures which backend New returns
+type Options struct {
+	// Backend is the storage backend to use, kube (default) or file
+	Backend string
+
+	// Namespace is the namespace devices are stored in by the kube backend
+	Namespace string
+
+	// Path is the directory devices are stored in by the file backend
+	Path string
+}
+
+// New returns the store for the configured backend
+func New(opts Options) (Store, error) {
+	switch opts.Backend {
+	case "", "kube":
+		return NewKube(opts.Namespace)
+	case "file":
+		return NewFile(opts.Path)
+	}
+
+	return nil, fmt.Errorf("unknown storage backend '%s'", opts.Backend)
+}